@@ -0,0 +1,129 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cdiVersion is the Container Device Interface spec version this plugin
+// writes. See https://github.com/cncf-tags/container-device-interface.
+const cdiVersion = "0.6.0"
+
+// cdiSpec mirrors the subset of the CDI spec JSON schema the plugin needs:
+// a kind and one device per discovered device ID.
+type cdiSpec struct {
+	CDIVersion string      `json:"cdiVersion"`
+	Kind       string      `json:"kind"`
+	Devices    []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// cdiKind returns the "vendor/class" kind used to qualify CDI device names,
+// falling back to the package defaults when the DeviceSpec doesn't
+// override them.
+func (gp *GenericPlugin) cdiKind() string {
+	vendor := gp.ds.CDIVendor
+	if vendor == "" {
+		vendor = defaultCDIVendor
+	}
+	class := gp.ds.CDIClass
+	if class == "" {
+		class = defaultCDIClass
+	}
+	return fmt.Sprintf("%s/%s", vendor, class)
+}
+
+// cdiDeviceName returns the fully-qualified CDI device name for the given
+// device ID, e.g. "example.com/generic=<deviceID>".
+func (gp *GenericPlugin) cdiDeviceName(id string) string {
+	return fmt.Sprintf("%s=%s", gp.cdiKind(), id)
+}
+
+// writeCDISpec (re)writes the CDI spec file for the plugin's resource,
+// enumerating every currently-discovered device. It is a no-op unless
+// CDIEnabled is set. It must be called with gp.mu held.
+func (gp *GenericPlugin) writeCDISpec() error {
+	if !gp.ds.CDIEnabled {
+		return nil
+	}
+
+	permissions := gp.ds.Permissions
+	if permissions == "" {
+		permissions = "mrw"
+	}
+
+	spec := cdiSpec{
+		CDIVersion: cdiVersion,
+		Kind:       gp.cdiKind(),
+	}
+	for _, d := range gp.devices {
+		var nodes []cdiDeviceNode
+		for _, path := range d.paths {
+			nodes = append(nodes, cdiDeviceNode{
+				Path:        path,
+				HostPath:    path,
+				Permissions: permissions,
+			})
+		}
+		spec.Devices = append(spec.Devices, cdiDevice{
+			Name:           d.ID,
+			ContainerEdits: cdiContainerEdits{DeviceNodes: nodes},
+		})
+	}
+
+	dir := gp.ds.CDIDir
+	if dir == "" {
+		dir = defaultCDIDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create CDI spec directory: %v", err)
+	}
+
+	b, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal CDI spec: %v", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("generic-device-plugin-%s.json", sanitizeResourceName(gp.ds.Resource)))
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("failed to write CDI spec file: %v", err)
+	}
+	return nil
+}
+
+// sanitizeResourceName replaces characters that aren't safe in a filename
+// (such as the "/" in "example.com/resource") with an underscore.
+func sanitizeResourceName(resource string) string {
+	return strings.ReplaceAll(resource, "/", "_")
+}
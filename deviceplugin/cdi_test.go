@@ -0,0 +1,116 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestWriteCDISpec(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{
+		Resource:   "example.com/widget",
+		CDIEnabled: true,
+		CDIDir:     t.TempDir(),
+	})
+	gp.devices["dev-1"] = device{
+		Device: v1beta1.Device{ID: "dev-1"},
+		paths:  []string{"/dev/widget0"},
+	}
+
+	if err := gp.writeCDISpec(); err != nil {
+		t.Fatalf("writeCDISpec: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(gp.ds.CDIDir, "generic-device-plugin-example.com_widget.json"))
+	if err != nil {
+		t.Fatalf("expected a CDI spec file to be written: %v", err)
+	}
+
+	var spec cdiSpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		t.Fatalf("failed to parse written CDI spec: %v", err)
+	}
+	if spec.CDIVersion != cdiVersion {
+		t.Fatalf("got cdiVersion %q, want %q", spec.CDIVersion, cdiVersion)
+	}
+	if spec.Kind != gp.cdiKind() {
+		t.Fatalf("got kind %q, want %q", spec.Kind, gp.cdiKind())
+	}
+	if len(spec.Devices) != 1 {
+		t.Fatalf("expected 1 device in the CDI spec, got %d", len(spec.Devices))
+	}
+	d := spec.Devices[0]
+	if d.Name != "dev-1" {
+		t.Fatalf("got device name %q, want %q", d.Name, "dev-1")
+	}
+	if len(d.ContainerEdits.DeviceNodes) != 1 {
+		t.Fatalf("expected 1 device node, got %d", len(d.ContainerEdits.DeviceNodes))
+	}
+	node := d.ContainerEdits.DeviceNodes[0]
+	if node.Path != "/dev/widget0" || node.HostPath != "/dev/widget0" {
+		t.Fatalf("unexpected device node: %+v", node)
+	}
+	if node.Permissions != "mrw" {
+		t.Fatalf("got default permissions %q, want \"mrw\"", node.Permissions)
+	}
+}
+
+func TestWriteCDISpecDisabled(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{Resource: "example.com/widget", CDIDir: t.TempDir()})
+	gp.devices["dev-1"] = device{Device: v1beta1.Device{ID: "dev-1"}}
+
+	if err := gp.writeCDISpec(); err != nil {
+		t.Fatalf("writeCDISpec: %v", err)
+	}
+
+	entries, err := os.ReadDir(gp.ds.CDIDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no CDI spec file when CDIEnabled is false, found %v", entries)
+	}
+}
+
+func TestWriteCDISpecHonorsPermissionsOverride(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{
+		Resource:    "example.com/widget",
+		CDIEnabled:  true,
+		CDIDir:      t.TempDir(),
+		Permissions: "r",
+	})
+	gp.devices["dev-1"] = device{Device: v1beta1.Device{ID: "dev-1"}, paths: []string{"/dev/widget0"}}
+
+	if err := gp.writeCDISpec(); err != nil {
+		t.Fatalf("writeCDISpec: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(gp.ds.CDIDir, "generic-device-plugin-example.com_widget.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var spec cdiSpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got := spec.Devices[0].ContainerEdits.DeviceNodes[0].Permissions; got != "r" {
+		t.Fatalf("got permissions %q, want %q", got, "r")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultAllocationTTL is how old a checkpointed allocation, counted from
+// when it was allocated, may be when the plugin restarts before
+// expireStaleAllocations expires it, when DeviceSpec.AllocationTTL is unset.
+const defaultAllocationTTL = 10 * time.Minute
+
+// allocationRecord is the persisted record of a single device allocation.
+//
+// The kubelet device plugin v1beta1 API doesn't pass the requesting pod's
+// UID or container name to Allocate, so allocations can only be tracked
+// and reconciled by device ID; HostPaths is kept so checkpoint files are
+// useful for debugging which host paths a device ID was handed out with.
+type allocationRecord struct {
+	HostPaths []string  `json:"hostPaths"`
+	Allocated time.Time `json:"allocated"`
+}
+
+// checkpointFile is the on-disk structure persisted to
+// <pluginDir>/checkpoint-<resource>.json.
+type checkpointFile struct {
+	Allocations map[string]allocationRecord `json:"allocations"`
+}
+
+// checkpointPath returns the path a resource's checkpoint file is
+// persisted to within pluginDir.
+func checkpointPath(pluginDir, resource string) string {
+	return filepath.Join(pluginDir, fmt.Sprintf("checkpoint-%s.json", sanitizeResourceName(resource)))
+}
+
+// loadCheckpoint reads a resource's checkpoint file, returning an empty
+// allocation map if it doesn't exist yet.
+func loadCheckpoint(path string) (map[string]allocationRecord, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[string]allocationRecord), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint file: %v", err)
+	}
+	var cf checkpointFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint file: %v", err)
+	}
+	if cf.Allocations == nil {
+		cf.Allocations = make(map[string]allocationRecord)
+	}
+	return cf.Allocations, nil
+}
+
+// persistCheckpoint writes the plugin's current allocation map to its
+// checkpoint file. It must be called with gp.mu held.
+func (gp *GenericPlugin) persistCheckpoint() error {
+	b, err := json.MarshalIndent(checkpointFile{Allocations: gp.allocations}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint file: %v", err)
+	}
+	if err := os.WriteFile(checkpointPath(gp.pluginDir, gp.ds.Resource), b, 0600); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %v", err)
+	}
+	return nil
+}
+
+// reconcileAllocations drops allocations for device IDs that no longer
+// exist, i.e. the underlying device disappeared, allowing the kubelet to
+// re-Allocate that ID. It reports whether any allocation was removed, and
+// must be called with gp.mu held.
+//
+// This intentionally does not also expire allocations on a wall-clock
+// timer: refreshDevices and Allocate call this on every tick and every
+// request, and there's no liveness signal in the v1beta1 API that tells
+// the plugin a long-running, healthy container is done with its device.
+// A TTL applied here would eventually evict an allocation out from under
+// a container that's still using it, handing the same device ID to a
+// second container on a Max-capped resource. Stale allocations left over
+// from before a plugin restart are instead expired once, by
+// expireStaleAllocations, before the checkpoint is ever handed to a
+// running GenericPlugin.
+func (gp *GenericPlugin) reconcileAllocations() bool {
+	var changed bool
+	for id := range gp.allocations {
+		if _, ok := gp.devices[id]; !ok {
+			delete(gp.allocations, id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// expireStaleAllocations drops allocations older than ttl (or
+// defaultAllocationTTL if ttl is zero) from a checkpoint loaded at
+// startup. It runs exactly once, right after NewGenericPlugin loads the
+// checkpoint and before the plugin starts serving: an allocation that's
+// survived this long with no kubelet activity almost certainly belongs to
+// a pod that's gone, and without this pass a checkpoint full of dead
+// allocations from a previous run would never be reclaimed since
+// reconcileAllocations only drops allocations for devices that vanish
+// outright.
+func expireStaleAllocations(allocations map[string]allocationRecord, ttl time.Duration) map[string]allocationRecord {
+	if ttl == 0 {
+		ttl = defaultAllocationTTL
+	}
+	now := time.Now()
+	for id, rec := range allocations {
+		if now.Sub(rec.Allocated) > ttl {
+			delete(allocations, id)
+		}
+	}
+	return allocations
+}
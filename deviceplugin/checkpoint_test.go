@@ -0,0 +1,132 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func newTestPlugin(t *testing.T, ds *DeviceSpec) *GenericPlugin {
+	t.Helper()
+	return &GenericPlugin{
+		ds:          ds,
+		pluginDir:   t.TempDir(),
+		devices:     make(map[string]device),
+		allocations: make(map[string]allocationRecord),
+		allocationsCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "test_allocations_total",
+		}),
+	}
+}
+
+func TestLoadCheckpointMissingFile(t *testing.T) {
+	allocations, err := loadCheckpoint(filepath.Join(t.TempDir(), "checkpoint-missing.json"))
+	if err != nil {
+		t.Fatalf("loadCheckpoint returned error for missing file: %v", err)
+	}
+	if len(allocations) != 0 {
+		t.Fatalf("expected no allocations for a missing checkpoint, got %d", len(allocations))
+	}
+}
+
+func TestPersistAndLoadCheckpointRoundTrip(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{Resource: "example.com/widget"})
+	gp.allocations["dev-1"] = allocationRecord{
+		HostPaths: []string{"/dev/widget0"},
+		Allocated: time.Unix(1000, 0).UTC(),
+	}
+
+	if err := gp.persistCheckpoint(); err != nil {
+		t.Fatalf("persistCheckpoint: %v", err)
+	}
+
+	loaded, err := loadCheckpoint(checkpointPath(gp.pluginDir, gp.ds.Resource))
+	if err != nil {
+		t.Fatalf("loadCheckpoint: %v", err)
+	}
+	rec, ok := loaded["dev-1"]
+	if !ok {
+		t.Fatalf("expected dev-1 to round-trip through the checkpoint file")
+	}
+	if len(rec.HostPaths) != 1 || rec.HostPaths[0] != "/dev/widget0" {
+		t.Fatalf("unexpected host paths: %v", rec.HostPaths)
+	}
+	if !rec.Allocated.Equal(gp.allocations["dev-1"].Allocated) {
+		t.Fatalf("allocated timestamp did not round-trip: got %v, want %v", rec.Allocated, gp.allocations["dev-1"].Allocated)
+	}
+}
+
+func TestReconcileAllocationsDropsOnlyMissingDevices(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{Resource: "example.com/widget", AllocationTTL: time.Minute})
+	gp.devices["present"] = device{Device: v1beta1.Device{ID: "present"}}
+	gp.devices["long-running"] = device{Device: v1beta1.Device{ID: "long-running"}}
+
+	gp.allocations["present"] = allocationRecord{Allocated: time.Now()}
+	// long-running simulates a healthy container that's held its device far
+	// longer than AllocationTTL; reconcileAllocations must never expire it on
+	// a wall-clock timer, only expireStaleAllocations at startup does that.
+	gp.allocations["long-running"] = allocationRecord{Allocated: time.Now().Add(-2 * time.Minute)}
+	gp.allocations["gone"] = allocationRecord{Allocated: time.Now()}
+
+	if changed := gp.reconcileAllocations(); !changed {
+		t.Fatalf("expected reconcileAllocations to report a change")
+	}
+	if _, ok := gp.allocations["present"]; !ok {
+		t.Fatalf("expected a fresh allocation of a still-present device to survive")
+	}
+	if _, ok := gp.allocations["long-running"]; !ok {
+		t.Fatalf("expected an allocation of a still-present device to survive regardless of age")
+	}
+	if _, ok := gp.allocations["gone"]; ok {
+		t.Fatalf("expected an allocation for a no-longer-discovered device to be dropped")
+	}
+
+	if changed := gp.reconcileAllocations(); changed {
+		t.Fatalf("expected a second reconcile with nothing missing to report no change")
+	}
+}
+
+func TestExpireStaleAllocationsOnStartup(t *testing.T) {
+	allocations := map[string]allocationRecord{
+		"fresh": {Allocated: time.Now()},
+		"stale": {Allocated: time.Now().Add(-2 * time.Minute)},
+	}
+
+	allocations = expireStaleAllocations(allocations, time.Minute)
+
+	if _, ok := allocations["fresh"]; !ok {
+		t.Fatalf("expected an allocation younger than ttl to survive")
+	}
+	if _, ok := allocations["stale"]; ok {
+		t.Fatalf("expected an allocation older than ttl to be expired")
+	}
+}
+
+func TestExpireStaleAllocationsDefaultsTTL(t *testing.T) {
+	allocations := map[string]allocationRecord{
+		"within-default": {Allocated: time.Now().Add(-time.Minute)},
+	}
+
+	allocations = expireStaleAllocations(allocations, 0)
+
+	if _, ok := allocations["within-default"]; !ok {
+		t.Fatalf("expected an allocation within defaultAllocationTTL to survive when ttl is unset")
+	}
+}
@@ -32,6 +32,15 @@ import (
 
 const (
 	deviceCheckInterval = 5 * time.Second
+
+	// defaultCDIVendor and defaultCDIClass make up the "vendor/class" kind
+	// used to build CDI device names when a DeviceSpec doesn't override them.
+	defaultCDIVendor = "generic-device-plugin.github.io"
+	defaultCDIClass  = "device"
+
+	// defaultCDIDir is where CDI specs are written when DeviceSpec.CDIDir
+	// is left unset.
+	defaultCDIDir = "/var/run/cdi"
 )
 
 // DeviceSpec defines a device type and the paths at which
@@ -40,6 +49,73 @@ type DeviceSpec struct {
 	Resource string
 	Groups   [][]string
 	Count    uint
+
+	// Max caps how many devices of each group the plugin advertises,
+	// independent of how many paths discover() finds, and how many
+	// concurrent allocations the resource accepts.
+	// When set, it overrides Count: refreshDevices synthesizes exactly Max
+	// device entries total for the group (not per matched path), each
+	// still backed by one of the group's globbed paths, and Allocate
+	// gates concurrent allocations across all of the resource's groups
+	// together at Max. This is the pattern used for
+	// purely-virtual, shared devices like /dev/fuse, where the plugin
+	// needs to advertise a fixed pool of slots rather than one device per
+	// host path.
+	Max uint
+
+	// CDIEnabled makes the plugin publish a Container Device Interface
+	// (CDI) spec for this resource and populate
+	// ContainerAllocateResponse.CDIDevices in Allocate, instead of the
+	// legacy inline device path list.
+	CDIEnabled bool
+	// CDIVendor and CDIClass set the "vendor/class" kind used to qualify
+	// CDI device names, e.g. "example.com/generic". They default to
+	// defaultCDIVendor and defaultCDIClass if unset.
+	CDIVendor string
+	CDIClass  string
+	// CDIDir is the directory the CDI spec for this resource is written
+	// to. Defaults to defaultCDIDir.
+	CDIDir string
+
+	// AllocationTTL bounds how old a checkpointed allocation, counted from
+	// when it was allocated, may be when the plugin restarts before
+	// expireStaleAllocations drops it as stale. It is applied only to the
+	// checkpoint loaded at startup. Defaults to defaultAllocationTTL if unset.
+	AllocationTTL time.Duration
+
+	// HealthCheck configures how device paths are probed for health. If
+	// nil, devices are always reported healthy, matching the previous
+	// behavior.
+	HealthCheck *HealthCheckSpec
+
+	// Topology supplies NUMA hints for each entry in Groups, aligned by
+	// index (Topology[i] describes Groups[i]). A shorter Topology slice,
+	// or a zero-value entry, leaves the corresponding group without NUMA
+	// information. See TopologyHint.
+	Topology []TopologyHint
+
+	// Permissions overrides the cgroup device permissions granted for
+	// each allocated device node. Defaults to "mrw" if unset. Applies
+	// equally to the inline device list and, when CDIEnabled is set, to
+	// the device nodes written into the CDI spec.
+	Permissions string
+	// Env is added to the environment of every container a device from
+	// this resource is allocated to.
+	Env map[string]string
+	// Mounts is added to every container a device from this resource is
+	// allocated to, in addition to the device nodes themselves.
+	Mounts []MountSpec
+	// Annotations is added to the allocation response for every container
+	// a device from this resource is allocated to.
+	Annotations map[string]string
+}
+
+// MountSpec is an extra bind mount added to a container in addition to
+// its allocated device nodes.
+type MountSpec struct {
+	HostPath      string
+	ContainerPath string
+	ReadOnly      bool
 }
 
 // device wraps the v1.beta1.Device type to add context about
@@ -47,20 +123,34 @@ type DeviceSpec struct {
 type device struct {
 	v1beta1.Device
 	paths []string
+
+	// groupIndex is the index into DeviceSpec.Groups this device was
+	// discovered from, used to recognize sibling devices when scoring
+	// preferred allocations.
+	groupIndex int
+	// numaNode is the NUMA node this device is on, or -1 if unknown. See
+	// TopologyHint.
+	numaNode int64
 }
 
 // GenericPlugin is a plugin for generic devices that can:
 // * be found using a file path; and
 // * mounted and used without special logic.
 type GenericPlugin struct {
-	ds      *DeviceSpec
-	devices map[string]device
-	logger  log.Logger
-	mu      sync.Mutex
+	ds        *DeviceSpec
+	pluginDir string
+	devices   map[string]device
+	// allocations records device IDs that are currently handed out, keyed
+	// by device ID, so they survive a restart of the plugin itself. See
+	// checkpoint.go.
+	allocations map[string]allocationRecord
+	logger      log.Logger
+	mu          sync.Mutex
 
 	// metrics
-	deviceGauge        prometheus.Gauge
-	allocationsCounter prometheus.Counter
+	deviceGauge          prometheus.Gauge
+	unhealthyDeviceGauge prometheus.Gauge
+	allocationsCounter   prometheus.Counter
 }
 
 // NewGenericPlugin creates a new plugin for a generic device.
@@ -69,14 +159,27 @@ func NewGenericPlugin(ds *DeviceSpec, pluginDir string, logger log.Logger, reg p
 		logger = log.NewNopLogger()
 	}
 
+	allocations, err := loadCheckpoint(checkpointPath(pluginDir, ds.Resource))
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to load allocation checkpoint, starting with no recorded allocations", "err", err)
+		allocations = make(map[string]allocationRecord)
+	}
+	allocations = expireStaleAllocations(allocations, ds.AllocationTTL)
+
 	gp := &GenericPlugin{
-		ds:      ds,
-		devices: make(map[string]device),
-		logger:  logger,
+		ds:          ds,
+		pluginDir:   pluginDir,
+		devices:     make(map[string]device),
+		allocations: allocations,
+		logger:      logger,
 		deviceGauge: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "generic_device_plugin_devices",
 			Help: "The number of devices managed by this device plugin.",
 		}),
+		unhealthyDeviceGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "generic_device_plugin_unhealthy_devices",
+			Help: "The number of devices managed by this device plugin that are currently unhealthy.",
+		}),
 		allocationsCounter: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "generic_device_plugin_allocations_total",
 			Help: "The total number of device allocations made by this device plugin.",
@@ -84,7 +187,7 @@ func NewGenericPlugin(ds *DeviceSpec, pluginDir string, logger log.Logger, reg p
 	}
 
 	if reg != nil {
-		reg.MustRegister(gp.deviceGauge, gp.allocationsCounter)
+		reg.MustRegister(gp.deviceGauge, gp.unhealthyDeviceGauge, gp.allocationsCounter)
 	}
 
 	return NewPlugin(ds.Resource, pluginDir, gp, logger, prometheus.WrapRegistererWithPrefix("generic_", reg))
@@ -92,7 +195,7 @@ func NewGenericPlugin(ds *DeviceSpec, pluginDir string, logger log.Logger, reg p
 
 func (gp *GenericPlugin) discover() ([]device, error) {
 	var devices []device
-	for _, group := range gp.ds.Groups {
+	for gi, group := range gp.ds.Groups {
 		paths := make([][]string, len(group))
 		var length int
 		// Discover all of the devices matching each pattern in the group.
@@ -108,22 +211,42 @@ func (gp *GenericPlugin) discover() ([]device, error) {
 				length = len(matches)
 			}
 		}
-		for i := 0; i < length; i++ {
-			for j := uint(0); j < gp.ds.Count; j++ {
-				h := sha1.New()
-				h.Write([]byte(strconv.FormatUint(uint64(j), 10)))
-				d := device{
-					Device: v1beta1.Device{
-						Health: v1beta1.Healthy,
-					},
-					paths: make([]string, len(group)),
-				}
-				for k := range group {
-					h.Write([]byte(paths[k][i]))
-					d.paths[k] = paths[k][i]
+		numaNodes, err := gp.numaNodesForGroup(gi, length)
+		if err != nil {
+			return nil, err
+		}
+
+		buildDevice := func(i int, j uint) device {
+			h := sha1.New()
+			h.Write([]byte(strconv.FormatUint(uint64(j), 10)))
+			d := device{
+				Device: v1beta1.Device{
+					Health: v1beta1.Healthy,
+				},
+				paths:      make([]string, len(group)),
+				groupIndex: gi,
+				numaNode:   numaNodes[i],
+			}
+			for k := range group {
+				h.Write([]byte(paths[k][i]))
+				d.paths[k] = paths[k][i]
+			}
+			d.ID = fmt.Sprintf("%x", h.Sum(nil))
+			return d
+		}
+
+		if gp.ds.Max > 0 {
+			// Max bounds the total number of synthesized devices for the
+			// group, not the number per matched path; round-robin across
+			// however many paths the group's patterns actually matched.
+			for j := uint(0); length > 0 && j < gp.ds.Max; j++ {
+				devices = append(devices, buildDevice(int(j)%length, j))
+			}
+		} else {
+			for i := 0; i < length; i++ {
+				for j := uint(0); j < gp.ds.Count; j++ {
+					devices = append(devices, buildDevice(i, j))
 				}
-				d.ID = fmt.Sprintf("%x", h.Sum(nil))
-				devices = append(devices, d)
 			}
 		}
 	}
@@ -139,7 +262,10 @@ func (gp *GenericPlugin) refreshDevices() (bool, error) {
 		return false, fmt.Errorf("failed to discover devices: %v", err)
 	}
 
+	unhealthy := gp.probeAllHealth(devices)
+
 	gp.deviceGauge.Set(float64(len(devices)))
+	gp.unhealthyDeviceGauge.Set(float64(unhealthy))
 
 	gp.mu.Lock()
 	defer gp.mu.Unlock()
@@ -156,6 +282,16 @@ func (gp *GenericPlugin) refreshDevices() (bool, error) {
 			equal = false
 		}
 	}
+	if err := gp.writeCDISpec(); err != nil {
+		return false, fmt.Errorf("failed to write CDI spec: %v", err)
+	}
+
+	if gp.reconcileAllocations() {
+		if err := gp.persistCheckpoint(); err != nil {
+			return false, fmt.Errorf("failed to persist allocation checkpoint: %v", err)
+		}
+	}
+
 	if !equal {
 		return false, nil
 	}
@@ -169,18 +305,40 @@ func (gp *GenericPlugin) refreshDevices() (bool, error) {
 	return true, nil
 }
 
-// GetDeviceState always returns healthy.
-func (gp *GenericPlugin) GetDeviceState(_ string) string {
-	return v1beta1.Healthy
+// GetDeviceState returns the last-probed health of the named device.
+func (gp *GenericPlugin) GetDeviceState(id string) string {
+	gp.mu.Lock()
+	defer gp.mu.Unlock()
+	dev, ok := gp.devices[id]
+	if !ok {
+		return v1beta1.Unhealthy
+	}
+	return dev.Health
 }
 
 // Allocate assigns generic devices to a Pod.
 func (gp *GenericPlugin) Allocate(_ context.Context, req *v1beta1.AllocateRequest) (*v1beta1.AllocateResponse, error) {
 	gp.mu.Lock()
 	defer gp.mu.Unlock()
+
+	gp.reconcileAllocations()
+
 	res := &v1beta1.AllocateResponse{
 		ContainerResponses: make([]*v1beta1.ContainerAllocateResponse, 0, len(req.ContainerRequests)),
 	}
+	permissions := gp.ds.Permissions
+	if permissions == "" {
+		permissions = "mrw"
+	}
+
+	// staged collects the allocation records to commit to gp.allocations
+	// once every container request in this call has validated cleanly, so
+	// a later failure (e.g. an unhealthy device further down the list)
+	// never strands earlier IDs in gp.allocations without a successful
+	// response to match.
+	staged := make(map[string]allocationRecord)
+	var newAllocations uint
+
 	for _, r := range req.ContainerRequests {
 		resp := new(v1beta1.ContainerAllocateResponse)
 		// Add all requested devices to to response.
@@ -192,16 +350,64 @@ func (gp *GenericPlugin) Allocate(_ context.Context, req *v1beta1.AllocateReques
 			if dev.Health != v1beta1.Healthy {
 				return nil, fmt.Errorf("requested device is not healthy %q", id)
 			}
-			for _, path := range dev.paths {
-				resp.Devices = append(resp.Devices, &v1beta1.DeviceSpec{
-					HostPath:      path,
-					ContainerPath: path,
-					Permissions:   "mrw",
+			// The kubelet re-invokes Allocate with the same device IDs on
+			// ordinary container restarts (crash loop, liveness-probe
+			// kill, OOM). The v1beta1 API doesn't tell us whether this is
+			// the same container asking again, so a re-request of an
+			// already-allocated ID is treated as idempotent rather than
+			// rejected; only a genuinely new allocation counts against Max.
+			if _, alreadyAllocated := gp.allocations[id]; !alreadyAllocated {
+				if gp.ds.Max > 0 && uint(len(gp.allocations))+newAllocations >= gp.ds.Max {
+					return nil, fmt.Errorf("allocation cap reached for resource %q (max %d)", gp.ds.Resource, gp.ds.Max)
+				}
+				newAllocations++
+			}
+			if gp.ds.CDIEnabled {
+				resp.CDIDevices = append(resp.CDIDevices, &v1beta1.CDIDevice{
+					Name: gp.cdiDeviceName(id),
 				})
+			} else {
+				for _, path := range dev.paths {
+					resp.Devices = append(resp.Devices, &v1beta1.DeviceSpec{
+						HostPath:      path,
+						ContainerPath: path,
+						Permissions:   permissions,
+					})
+				}
+			}
+			staged[id] = allocationRecord{
+				HostPaths: dev.paths,
+				Allocated: time.Now(),
+			}
+		}
+		if len(gp.ds.Env) > 0 {
+			resp.Envs = make(map[string]string, len(gp.ds.Env))
+			for k, v := range gp.ds.Env {
+				resp.Envs[k] = v
+			}
+		}
+		for _, m := range gp.ds.Mounts {
+			resp.Mounts = append(resp.Mounts, &v1beta1.Mount{
+				HostPath:      m.HostPath,
+				ContainerPath: m.ContainerPath,
+				ReadOnly:      m.ReadOnly,
+			})
+		}
+		if len(gp.ds.Annotations) > 0 {
+			resp.Annotations = make(map[string]string, len(gp.ds.Annotations))
+			for k, v := range gp.ds.Annotations {
+				resp.Annotations[k] = v
 			}
 		}
 		res.ContainerResponses = append(res.ContainerResponses, resp)
 	}
+
+	for id, rec := range staged {
+		gp.allocations[id] = rec
+	}
+	if err := gp.persistCheckpoint(); err != nil {
+		return nil, fmt.Errorf("failed to persist allocation checkpoint: %v", err)
+	}
 	gp.allocationsCounter.Add(float64(len(res.ContainerResponses)))
 	return res, nil
 }
@@ -223,7 +429,11 @@ func (gp *GenericPlugin) ListAndWatch(_ *v1beta1.Empty, stream v1beta1.DevicePlu
 		if !ok {
 			res := new(v1beta1.ListAndWatchResponse)
 			for _, dev := range gp.devices {
-				res.Devices = append(res.Devices, &v1beta1.Device{ID: dev.ID, Health: dev.Health})
+				res.Devices = append(res.Devices, &v1beta1.Device{
+					ID:       dev.ID,
+					Health:   dev.Health,
+					Topology: dev.topologyInfo(),
+				})
 			}
 			if err := stream.Send(res); err != nil {
 				return err
@@ -242,7 +452,20 @@ func (gp *GenericPlugin) PreStartContainer(_ context.Context, _ *v1beta1.PreStar
 	return &v1beta1.PreStartContainerResponse{}, nil
 }
 
-// GetPreferredAllocation always returns an empty response.
-func (gp *GenericPlugin) GetPreferredAllocation(context.Context, *v1beta1.PreferredAllocationRequest) (*v1beta1.PreferredAllocationResponse, error) {
-	return &v1beta1.PreferredAllocationResponse{}, nil
+// GetPreferredAllocation scores the devices available to each container
+// request by NUMA locality and group affinity, returning the subset the
+// kubelet's TopologyManager should prefer. See preferredAllocation.
+func (gp *GenericPlugin) GetPreferredAllocation(_ context.Context, req *v1beta1.PreferredAllocationRequest) (*v1beta1.PreferredAllocationResponse, error) {
+	gp.mu.Lock()
+	defer gp.mu.Unlock()
+
+	resp := &v1beta1.PreferredAllocationResponse{
+		ContainerResponses: make([]*v1beta1.ContainerPreferredAllocationResponse, 0, len(req.ContainerRequests)),
+	}
+	for _, r := range req.ContainerRequests {
+		resp.ContainerResponses = append(resp.ContainerResponses, &v1beta1.ContainerPreferredAllocationResponse{
+			DeviceIDs: gp.preferredAllocation(r.AvailableDeviceIDs, r.MustIncludeDeviceIDs, int(r.AllocationSize)),
+		})
+	}
+	return resp, nil
 }
@@ -0,0 +1,125 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDiscoverCapsDevicesAtMaxPerGroup(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"fuse0", "fuse1"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	gp := newTestPlugin(t, &DeviceSpec{
+		Resource: "example.com/fuse",
+		Groups:   [][]string{{filepath.Join(dir, "fuse*")}},
+		Max:      5,
+	})
+
+	devices, err := gp.discover()
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if len(devices) != 5 {
+		t.Fatalf("expected Max (5) synthesized devices regardless of the 2 matched paths, got %d", len(devices))
+	}
+}
+
+func TestAllocateRespectsMaxCap(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{Resource: "example.com/fuse", Max: 2})
+	gp.devices["d0"] = device{Device: v1beta1.Device{ID: "d0", Health: v1beta1.Healthy}, paths: []string{"/dev/fuse"}}
+	gp.devices["d1"] = device{Device: v1beta1.Device{ID: "d1", Health: v1beta1.Healthy}, paths: []string{"/dev/fuse"}}
+	gp.devices["d2"] = device{Device: v1beta1.Device{ID: "d2", Health: v1beta1.Healthy}, paths: []string{"/dev/fuse"}}
+
+	req := func(id string) *v1beta1.AllocateRequest {
+		return &v1beta1.AllocateRequest{
+			ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{id}}},
+		}
+	}
+
+	if _, err := gp.Allocate(context.Background(), req("d0")); err != nil {
+		t.Fatalf("Allocate d0: %v", err)
+	}
+	if _, err := gp.Allocate(context.Background(), req("d1")); err != nil {
+		t.Fatalf("Allocate d1: %v", err)
+	}
+	if _, err := gp.Allocate(context.Background(), req("d2")); err == nil {
+		t.Fatalf("expected Allocate to reject a 3rd allocation once Max (2) is reached")
+	}
+
+	// Re-allocating an already-allocated ID (e.g. a kubelet-driven container
+	// restart) must stay idempotent rather than counting a second time
+	// against Max.
+	if _, err := gp.Allocate(context.Background(), req("d0")); err != nil {
+		t.Fatalf("expected re-Allocate of an already-allocated device to succeed, got: %v", err)
+	}
+}
+
+func TestAllocateRejectsUnhealthyDevice(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{Resource: "example.com/widget"})
+	gp.devices["d0"] = device{Device: v1beta1.Device{ID: "d0", Health: v1beta1.Unhealthy}, paths: []string{"/dev/widget0"}}
+
+	req := &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"d0"}}},
+	}
+	if _, err := gp.Allocate(context.Background(), req); err == nil {
+		t.Fatalf("expected Allocate to reject an unhealthy device")
+	}
+}
+
+func TestAllocatePopulatesEnvMountsAnnotations(t *testing.T) {
+	gp := newTestPlugin(t, &DeviceSpec{
+		Resource:    "example.com/tpm",
+		Permissions: "r",
+		Env:         map[string]string{"TPM_DEVICE": "/dev/tpm0"},
+		Mounts:      []MountSpec{{HostPath: "/dev/tpm0", ContainerPath: "/dev/tpm0", ReadOnly: true}},
+		Annotations: map[string]string{"tpm.example.com/shared": "true"},
+	})
+	gp.devices["d0"] = device{Device: v1beta1.Device{ID: "d0", Health: v1beta1.Healthy}, paths: []string{"/dev/tpm0"}}
+
+	req := &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"d0"}}},
+	}
+	res, err := gp.Allocate(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if len(res.ContainerResponses) != 1 {
+		t.Fatalf("expected 1 container response, got %d", len(res.ContainerResponses))
+	}
+	resp := res.ContainerResponses[0]
+
+	if got := resp.Envs["TPM_DEVICE"]; got != "/dev/tpm0" {
+		t.Fatalf("got env TPM_DEVICE=%q, want /dev/tpm0", got)
+	}
+	if len(resp.Mounts) != 1 || !resp.Mounts[0].ReadOnly || resp.Mounts[0].HostPath != "/dev/tpm0" {
+		t.Fatalf("unexpected mounts: %+v", resp.Mounts)
+	}
+	if got := resp.Annotations["tpm.example.com/shared"]; got != "true" {
+		t.Fatalf("got annotation %q, want \"true\"", got)
+	}
+	if len(resp.Devices) != 1 || resp.Devices[0].Permissions != "r" {
+		t.Fatalf("expected the Permissions override (\"r\") applied to the device node, got %+v", resp.Devices)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// maxConcurrentProbes bounds how many device health probes run at once in
+// probeAllHealth. Probing sequentially on the ListAndWatch goroutine would
+// let a single slow or stuck exec/open check stall device-set updates for
+// the whole resource, while unbounded concurrency would start one probe per
+// device at once for a DeviceSpec.Max-based resource that synthesizes
+// thousands of devices.
+const maxConcurrentProbes = 16
+
+// Health check types supported by HealthCheckSpec.Type.
+const (
+	HealthCheckStat = "stat"
+	HealthCheckOpen = "open"
+	HealthCheckExec = "exec"
+)
+
+// defaultHealthCheckTimeout bounds a single health probe when
+// HealthCheckSpec.Timeout is unset.
+const defaultHealthCheckTimeout = 2 * time.Second
+
+// HealthCheckSpec configures how a DeviceSpec's device paths are probed
+// for health between each refreshDevices run.
+type HealthCheckSpec struct {
+	// Type selects the probe strategy: HealthCheckStat (default) merely
+	// stats the path, HealthCheckOpen opens it for reading, and
+	// HealthCheckExec runs Command with the path as its sole argument,
+	// treating a non-zero exit as unhealthy. HealthCheckOpen can leak a
+	// goroutine per probe if the path blocks on open (see probeOpen);
+	// prefer HealthCheckStat or HealthCheckExec for paths that can hang.
+	Type string
+	// Interval is informational; probing happens on the plugin's regular
+	// deviceCheckInterval cadence, not a separate timer.
+	Interval time.Duration
+	// Timeout bounds a single probe. Defaults to defaultHealthCheckTimeout.
+	Timeout time.Duration
+	// Command is the executable run for HealthCheckExec.
+	Command string
+}
+
+// probe runs the configured check against path, returning a non-nil error
+// if the device should be considered unhealthy.
+func (hc *HealthCheckSpec) probe(path string) error {
+	timeout := hc.Timeout
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	switch hc.Type {
+	case HealthCheckOpen:
+		return probeOpen(path, timeout)
+	case HealthCheckExec:
+		return probeExec(hc.Command, path, timeout)
+	case HealthCheckStat, "":
+		return probeStat(path)
+	default:
+		return fmt.Errorf("unknown health check type %q", hc.Type)
+	}
+}
+
+// probeHealth reports d's health according to gp.ds.HealthCheck, or
+// v1beta1.Healthy if no health check is configured.
+func (gp *GenericPlugin) probeHealth(d *device) string {
+	hc := gp.ds.HealthCheck
+	if hc == nil {
+		return v1beta1.Healthy
+	}
+	for _, path := range d.paths {
+		if err := hc.probe(path); err != nil {
+			level.Debug(gp.logger).Log("msg", "device health probe failed", "id", d.ID, "path", path, "err", err)
+			return v1beta1.Unhealthy
+		}
+	}
+	return v1beta1.Healthy
+}
+
+// probeAllHealth probes the health of every device in devices, writing the
+// result back into each entry's Health field, and returns the number found
+// unhealthy. Probes run with up to maxConcurrentProbes in flight so a slow
+// or stuck probe can't serialize device-set refreshes across a large
+// DeviceSpec.Max-based resource.
+func (gp *GenericPlugin) probeAllHealth(devices []device) int {
+	if gp.ds.HealthCheck == nil {
+		return 0
+	}
+
+	sem := make(chan struct{}, maxConcurrentProbes)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unhealthy int
+
+	for i := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			health := gp.probeHealth(&devices[i])
+			devices[i].Health = health
+			if health != v1beta1.Healthy {
+				mu.Lock()
+				unhealthy++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return unhealthy
+}
+
+// probeStat considers a device healthy if its path still exists.
+func probeStat(path string) error {
+	_, err := os.Stat(path)
+	return err
+}
+
+// probeOpen considers a device healthy if it can be opened for reading
+// within timeout.
+//
+// os.OpenFile has no cancellation mechanism, so a path backed by a wedged
+// driver or a hung FUSE mount can block the inner goroutine forever; on
+// timeout this returns without waiting for it, leaking that goroutine for
+// the life of the process. Since probeAllHealth re-runs every
+// deviceCheckInterval, a single consistently-hanging path leaks one more
+// goroutine per tick, indefinitely. Prefer HealthCheckStat for devices that
+// are just files on disk, and HealthCheckExec (which probes via
+// exec.CommandContext and so can actually be killed on timeout) over
+// HealthCheckOpen for any path that can block on open.
+func probeOpen(path string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err == nil {
+			f.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out opening %q", path)
+	}
+}
+
+// probeExec considers a device healthy if `command path` exits zero
+// within timeout.
+func probeExec(command, path string, timeout time.Duration) error {
+	if command == "" {
+		return fmt.Errorf("health check type %q requires a command", HealthCheckExec)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return exec.CommandContext(ctx, command, path).Run()
+}
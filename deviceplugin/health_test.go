@@ -0,0 +1,88 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestProbeHealthTypes(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present")
+	if err := os.WriteFile(present, nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name string
+		hc   *HealthCheckSpec
+		path string
+		want string
+	}{
+		{name: "nil health check defaults healthy", hc: nil, path: missing, want: v1beta1.Healthy},
+		{name: "stat present path is healthy", hc: &HealthCheckSpec{Type: HealthCheckStat}, path: present, want: v1beta1.Healthy},
+		{name: "stat missing path is unhealthy", hc: &HealthCheckSpec{Type: HealthCheckStat}, path: missing, want: v1beta1.Unhealthy},
+		{name: "open present path is healthy", hc: &HealthCheckSpec{Type: HealthCheckOpen}, path: present, want: v1beta1.Healthy},
+		{name: "open missing path is unhealthy", hc: &HealthCheckSpec{Type: HealthCheckOpen}, path: missing, want: v1beta1.Unhealthy},
+		{name: "unknown type is unhealthy", hc: &HealthCheckSpec{Type: "bogus"}, path: present, want: v1beta1.Unhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gp := &GenericPlugin{ds: &DeviceSpec{HealthCheck: tt.hc}, logger: log.NewNopLogger()}
+			d := &device{Device: v1beta1.Device{ID: "d0"}, paths: []string{tt.path}}
+			if got := gp.probeHealth(d); got != tt.want {
+				t.Fatalf("got health %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeAllHealthCountsUnhealthy(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present")
+	if err := os.WriteFile(present, nil, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	gp := &GenericPlugin{ds: &DeviceSpec{HealthCheck: &HealthCheckSpec{Type: HealthCheckStat}}, logger: log.NewNopLogger()}
+	devices := []device{
+		{Device: v1beta1.Device{ID: "healthy"}, paths: []string{present}},
+		{Device: v1beta1.Device{ID: "unhealthy"}, paths: []string{filepath.Join(dir, "missing")}},
+	}
+
+	if got := gp.probeAllHealth(devices); got != 1 {
+		t.Fatalf("expected 1 unhealthy device, got %d", got)
+	}
+	if devices[0].Health != v1beta1.Healthy {
+		t.Fatalf("expected devices[0] to be marked healthy, got %q", devices[0].Health)
+	}
+	if devices[1].Health != v1beta1.Unhealthy {
+		t.Fatalf("expected devices[1] to be marked unhealthy, got %q", devices[1].Health)
+	}
+}
+
+func TestProbeExecRequiresCommand(t *testing.T) {
+	if err := probeExec("", "/dev/null", time.Second); err == nil {
+		t.Fatalf("expected an error when HealthCheckExec has no Command")
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// noNUMANode marks a device with no known NUMA affinity.
+const noNUMANode int64 = -1
+
+// TopologyHint describes how to determine the NUMA node for the devices
+// discovered from one DeviceSpec.Groups entry. Exactly one of NumaNode or
+// NumaHintFrom should be set; if neither is, the group is treated as
+// having no NUMA affinity.
+type TopologyHint struct {
+	// NumaNode hard-codes the NUMA node for every device in the group.
+	NumaNode *int64
+	// NumaHintFrom is a glob pattern, evaluated the same way as a Groups
+	// path pattern and matched by position to it, pointing at a sysfs
+	// file (e.g. ".../device/numa_node") to read the NUMA node from for
+	// each discovered device.
+	NumaHintFrom string
+}
+
+// numaNodesForGroup resolves the NUMA node for each of the length devices
+// discovered from DeviceSpec.Groups[gi].
+func (gp *GenericPlugin) numaNodesForGroup(gi, length int) ([]int64, error) {
+	nodes := make([]int64, length)
+	for i := range nodes {
+		nodes[i] = noNUMANode
+	}
+
+	if gi >= len(gp.ds.Topology) {
+		return nodes, nil
+	}
+	hint := gp.ds.Topology[gi]
+
+	if hint.NumaNode != nil {
+		for i := range nodes {
+			nodes[i] = *hint.NumaNode
+		}
+		return nodes, nil
+	}
+
+	if hint.NumaHintFrom == "" {
+		return nodes, nil
+	}
+
+	matches, err := filepath.Glob(hint.NumaHintFrom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to glob NUMA hint pattern: %v", err)
+	}
+	sort.Strings(matches)
+	for i := 0; i < length && i < len(matches); i++ {
+		node, err := readNUMANode(matches[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read NUMA node from %q: %v", matches[i], err)
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// readNUMANode parses a sysfs "numa_node" file, which contains -1 when the
+// device has no NUMA affinity.
+func readNUMANode(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return noNUMANode, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// topologyInfo returns the v1beta1.TopologyInfo to advertise for d, or nil
+// if its NUMA node is unknown.
+func (d *device) topologyInfo() *v1beta1.TopologyInfo {
+	if d.numaNode < 0 {
+		return nil
+	}
+	return &v1beta1.TopologyInfo{
+		Nodes: []*v1beta1.NUMANode{{ID: d.numaNode}},
+	}
+}
+
+// preferredAllocation picks size device IDs from available, always
+// including every ID in mustInclude. It prefers, in order: (1) devices
+// that share a NUMA node, choosing the node with the smallest set of
+// candidates that can still satisfy size and mustInclude; (2) devices
+// whose Groups entry matches that of the mustInclude devices, so sibling
+// paths from the same group are kept together, and otherwise the lowest
+// Groups index; (3) the lowest device ID, for determinism. It must be called with gp.mu held.
+func (gp *GenericPlugin) preferredAllocation(available, mustInclude []string, size int) []string {
+	if size <= 0 || size > len(available) {
+		size = len(available)
+	}
+
+	must := make(map[string]bool, len(mustInclude))
+	for _, id := range mustInclude {
+		must[id] = true
+	}
+
+	byNode := make(map[int64][]string)
+	for _, id := range available {
+		node := noNUMANode
+		if dev, ok := gp.devices[id]; ok {
+			node = dev.numaNode
+		}
+		byNode[node] = append(byNode[node], id)
+	}
+
+	candidates := gp.bestNUMACandidates(byNode, must, size, available)
+
+	groupPriority := gp.dominantGroup(mustInclude)
+	sort.Slice(candidates, func(i, j int) bool {
+		gi, gj := gp.devices[candidates[i]].groupIndex, gp.devices[candidates[j]].groupIndex
+		if groupPriority >= 0 {
+			pi, pj := gi == groupPriority, gj == groupPriority
+			if pi != pj {
+				return pi
+			}
+		}
+		if gi != gj {
+			return gi < gj
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	selected := make([]string, 0, size)
+	seen := make(map[string]bool, size)
+
+	mustSorted := append([]string(nil), mustInclude...)
+	sort.Strings(mustSorted)
+	for _, id := range mustSorted {
+		if len(selected) >= size || seen[id] {
+			continue
+		}
+		selected = append(selected, id)
+		seen[id] = true
+	}
+	for _, id := range candidates {
+		if len(selected) >= size {
+			break
+		}
+		if seen[id] {
+			continue
+		}
+		selected = append(selected, id)
+		seen[id] = true
+	}
+	return selected
+}
+
+// bestNUMACandidates returns the candidate pool preferredAllocation should
+// draw from: the smallest NUMA node big enough to satisfy size and every
+// must-include ID, or every available ID if no single node qualifies.
+func (gp *GenericPlugin) bestNUMACandidates(byNode map[int64][]string, must map[string]bool, size int, available []string) []string {
+	var bestIDs []string
+	haveBest := false
+	var bestNode int64
+	for node, ids := range byNode {
+		if len(ids) < size {
+			continue
+		}
+		idSet := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			idSet[id] = true
+		}
+		satisfiesMust := true
+		for id := range must {
+			if !idSet[id] {
+				satisfiesMust = false
+				break
+			}
+		}
+		if !satisfiesMust {
+			continue
+		}
+		if !haveBest || len(ids) < len(bestIDs) || (len(ids) == len(bestIDs) && node < bestNode) {
+			bestIDs = ids
+			bestNode = node
+			haveBest = true
+		}
+	}
+	if !haveBest {
+		return append([]string(nil), available...)
+	}
+	return append([]string(nil), bestIDs...)
+}
+
+// dominantGroup returns the Groups index most must-include devices belong
+// to, or -1 if mustInclude is empty.
+func (gp *GenericPlugin) dominantGroup(mustInclude []string) int {
+	if len(mustInclude) == 0 {
+		return -1
+	}
+	counts := make(map[int]int)
+	for _, id := range mustInclude {
+		if dev, ok := gp.devices[id]; ok {
+			counts[dev.groupIndex]++
+		}
+	}
+	best := -1
+	for gi, c := range counts {
+		if best == -1 || c > counts[best] || (c == counts[best] && gi < best) {
+			best = gi
+		}
+	}
+	return best
+}
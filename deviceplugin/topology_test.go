@@ -0,0 +1,104 @@
+// Copyright 2020 the generic-device-plugin authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deviceplugin
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func newTopologyDevice(id string, groupIndex int, numaNode int64) device {
+	return device{
+		Device:     v1beta1.Device{ID: id, Health: v1beta1.Healthy},
+		groupIndex: groupIndex,
+		numaNode:   numaNode,
+	}
+}
+
+func TestPreferredAllocationPrefersSameNUMANode(t *testing.T) {
+	gp := &GenericPlugin{
+		devices: map[string]device{
+			"a0": newTopologyDevice("a0", 0, 0),
+			"a1": newTopologyDevice("a1", 0, 0),
+			"b0": newTopologyDevice("b0", 0, 1),
+			"b1": newTopologyDevice("b1", 0, 1),
+		},
+	}
+
+	got := gp.preferredAllocation([]string{"a0", "a1", "b0", "b1"}, nil, 2)
+	sort.Strings(got)
+	if want := []string{"a0", "a1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestPreferredAllocationHonorsMustInclude(t *testing.T) {
+	gp := &GenericPlugin{
+		devices: map[string]device{
+			"a0": newTopologyDevice("a0", 0, 0),
+			"a1": newTopologyDevice("a1", 0, 0),
+			"b0": newTopologyDevice("b0", 0, 1),
+		},
+	}
+
+	got := gp.preferredAllocation([]string{"a0", "a1", "b0"}, []string{"b0"}, 2)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 devices, got %v", got)
+	}
+	var foundMust bool
+	for _, id := range got {
+		if id == "b0" {
+			foundMust = true
+		}
+	}
+	if !foundMust {
+		t.Fatalf("expected must-include device b0 in result, got %v", got)
+	}
+}
+
+func TestPreferredAllocationBreaksTiesByLowestID(t *testing.T) {
+	gp := &GenericPlugin{
+		devices: map[string]device{
+			"d2": newTopologyDevice("d2", 0, noNUMANode),
+			"d1": newTopologyDevice("d1", 0, noNUMANode),
+			"d0": newTopologyDevice("d0", 0, noNUMANode),
+		},
+	}
+
+	got := gp.preferredAllocation([]string{"d2", "d1", "d0"}, nil, 1)
+	if want := []string{"d0"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestDominantGroup(t *testing.T) {
+	gp := &GenericPlugin{
+		devices: map[string]device{
+			"a": newTopologyDevice("a", 1, 0),
+			"b": newTopologyDevice("b", 1, 0),
+			"c": newTopologyDevice("c", 2, 0),
+		},
+	}
+
+	if got := gp.dominantGroup(nil); got != -1 {
+		t.Fatalf("expected -1 for an empty mustInclude, got %d", got)
+	}
+	if got := gp.dominantGroup([]string{"a", "b", "c"}); got != 1 {
+		t.Fatalf("expected the group with more must-include devices (1), got %d", got)
+	}
+}